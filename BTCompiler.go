@@ -1,17 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/brewtroller/BTCloudCompilerService/internal/jobs"
 	"github.com/gorilla/mux"
 	"github.com/kardianos/osext"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,23 +32,166 @@ const version = "1.0.0"
 
 const SourceDir = "/BrewTroller"
 const OptionsFileName = "/BrewTroller/options.json"
+const EepromFileName = "eeprom.json"
 
 // Command line flags
 var (
 	debugMode  = flag.Bool("debug", false, "Enables server debug mode")
 	pollPeriod = flag.Duration("poll", 5*time.Minute, "Github poll period")
 	gitRepo    = flag.String("git", "http://github.com/brewtroller/brewtroller", "BrewTroller Remote Repository")
+	workers    = flag.Int("workers", 2, "Number of concurrent build jobs to run")
+	jobTTL     = flag.Duration("job-ttl", time.Hour, "How long finished jobs are kept before being swept")
+	cacheSize  = flag.Int64("cache-size", 1<<30, "Max bytes of on-disk build cache to retain (LRU eviction)")
+
+	builderKind  = flag.String("builder", "host", "Build executor: host, podman or docker")
+	builderImage = flag.String("builder-image", "brewtroller/avr-toolchain:latest", "Container image used by the podman/docker builder")
+	buildTimeout = flag.Duration("build-timeout", 10*time.Minute, "Maximum wall-clock time allowed for a single build")
+
+	webhookSecret = flag.String("webhook-secret", "", "Shared secret for validating GitHub webhook signatures; enables POST /webhook/github")
 )
 
+const jobSweepInterval = 5 * time.Minute
+
 type BuildServer struct {
 	version    string
 	gitURL     string
 	pollPeriod time.Duration
 
+	webhookSecret string
+	wakeup        chan struct{} //Signals the poll worker to refresh immediately
+
 	execFolder string
 
-	mu           sync.RWMutex //Protect the version tags and the source dir
+	mu           sync.RWMutex //Protect the version tags and the source dir, plus the build cache index below
 	optionsCache map[string][]map[string]interface{}
+
+	jobs    *jobs.Queue
+	builder Builder
+
+	cacheDir     string
+	cacheSizeCap int64
+	cacheIndex   map[string]*cacheEntry
+	cacheHits    int64
+	cacheMisses  int64
+}
+
+// cacheEntry is the persisted (<sha>.meta.json) record for one build cache
+// entry. It tracks the flash binary alongside the EEPROM image and
+// user_config.json built from the same options, so a cache hit can return
+// the same {flash,eeprom,user_config} shape as a fresh build.
+type cacheEntry struct {
+	Sha          string                 `json:"sha"`
+	BinarySha256 string                 `json:"binarySha256"`
+	Options      map[string]interface{} `json:"options"`
+	Log          string                 `json:"log,omitempty"`
+	Size         int64                  `json:"size"`
+	CreatedAt    time.Time              `json:"createdAt"`
+	AccessedAt   time.Time              `json:"accessedAt"`
+
+	EepromSha256     string `json:"eepromSha256,omitempty"`
+	EepromSize       int64  `json:"eepromSize,omitempty"`
+	UserConfigSha256 string `json:"userConfigSha256,omitempty"`
+	UserConfigSize   int64  `json:"userConfigSize,omitempty"`
+}
+
+// BuildOptions is the board/cmake-define pair a Builder needs to produce a
+// firmware image; it deliberately excludes where the source lives, since
+// that's a path in the builder's own frame of reference (host tempdir vs.
+// container bind mount).
+type BuildOptions struct {
+	Board        string
+	CmakeDefines []string
+}
+
+// Result is what a successful Builder.Build produces.
+type Result struct {
+	Binary []byte
+}
+
+// Builder runs cmake+make against a checked-out source tree and returns the
+// resulting firmware hex. Implementations decide where that actually
+// executes - directly on the host, or sandboxed inside a container.
+type Builder interface {
+	Build(ctx context.Context, srcDir string, opts BuildOptions, log io.Writer) (Result, error)
+}
+
+// hostBuilder runs cmake+make as the server's own process, in the server's
+// own filesystem namespace. This is the long-standing behavior.
+type hostBuilder struct{}
+
+func (hostBuilder) Build(ctx context.Context, srcDir string, opts BuildOptions, log io.Writer) (Result, error) {
+	buildDir := path.Join(srcDir, "build")
+	if err := os.MkdirAll(buildDir, 0777); err != nil {
+		return Result{}, err
+	}
+	enc := json.NewEncoder(log)
+
+	cmakeArgs := append(append([]string{}, opts.CmakeDefines...), srcDir)
+	cmakeCmd := exec.CommandContext(ctx, "cmake", cmakeArgs...)
+	cmakeCmd.Dir = buildDir
+	if _, err := streamCmd(enc, nopFlusher{}, "cmake", cmakeCmd, nil); err != nil {
+		return Result{}, err
+	}
+
+	makeCmd := exec.CommandContext(ctx, "make")
+	makeCmd.Dir = buildDir
+	if _, err := streamCmd(enc, nopFlusher{}, "make", makeCmd, nil); err != nil {
+		return Result{}, err
+	}
+
+	binary, err := ioutil.ReadFile(buildDir + "/src/BrewTroller-" + opts.Board + ".hex")
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Binary: binary}, nil
+}
+
+// containerBuilder sandboxes the cmake+make run inside a network-less
+// container with a read-only root filesystem so an untrusted POSTer's -D values
+// can't reach the host's cmake.
+type containerBuilder struct {
+	runtime string // "podman" or "docker"
+	image   string
+}
+
+func (b containerBuilder) Build(ctx context.Context, srcDir string, opts BuildOptions, log io.Writer) (Result, error) {
+	script := "#!/bin/sh\nset -e\nmkdir -p /work/build\ncd /work/build\ncmake \"$@\" /work\nmake\n"
+	if err := ioutil.WriteFile(path.Join(srcDir, "build.sh"), []byte(script), 0755); err != nil {
+		return Result{}, err
+	}
+
+	args := []string{"run", "--rm", "--network=none", "--read-only", "-v", srcDir + ":/work:Z", b.image, "/work/build.sh"}
+	args = append(args, opts.CmakeDefines...)
+
+	cmd := exec.CommandContext(ctx, b.runtime, args...)
+	enc := json.NewEncoder(log)
+	if _, err := streamCmd(enc, nopFlusher{}, "build", cmd, nil); err != nil {
+		return Result{}, err
+	}
+
+	binary, err := ioutil.ReadFile(path.Join(srcDir, "build", "src", "BrewTroller-"+opts.Board+".hex"))
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Binary: binary}, nil
+}
+
+// newBuilder resolves the -builder flag to a Builder. "podman" falls back
+// to "docker" if podman isn't on PATH, matching how most hosts only have one
+// of the two installed.
+func newBuilder(kind, image string) Builder {
+	switch kind {
+	case "podman", "docker":
+		runtime := kind
+		if kind == "podman" {
+			if _, err := exec.LookPath("podman"); err != nil {
+				runtime = "docker"
+			}
+		}
+		return containerBuilder{runtime: runtime, image: image}
+	default:
+		return hostBuilder{}
+	}
 }
 
 func (bs *BuildServer) updateTags() {
@@ -61,15 +214,11 @@ func (bs *BuildServer) updateTags() {
 
 	for true {
 		bs.mu.Lock()
-		//Clear out all current tags, in case any have been removed
-		clearCmd := exec.Command("git", "tag", "-l")
-		clearCmd.Dir = localSrcDir
-		removeCmd := exec.Command("xargs", "git", "tag", "-d")
-		removeCmd.Dir = localSrcDir
-		removeCmd.Stdin, _ = clearCmd.StdoutPipe()
-		removeCmd.Start()
-		clearCmd.Run()
-		removeCmd.Wait()
+		//Refresh tags in one shot - fetches new tags and drops any that were
+		//deleted upstream, so we never end up tracking a stale local tag.
+		fetchTagsCmd := exec.Command("git", "fetch", "--tags", "--prune", "--prune-tags")
+		fetchTagsCmd.Dir = localSrcDir
+		fetchTagsCmd.Run()
 
 		//Update the local repo
 		pullCmd := exec.Command("git", "pull")
@@ -92,7 +241,12 @@ func (bs *BuildServer) updateTags() {
 		bs.updateOptions(versionTags)
 
 		bs.mu.Unlock()
-		time.Sleep(bs.pollPeriod)
+
+		//Wait for either the poll period to elapse or a webhook wakeup.
+		select {
+		case <-time.After(bs.pollPeriod):
+		case <-bs.wakeup:
+		}
 	}
 }
 
@@ -131,9 +285,18 @@ func (bs *BuildServer) updateOptions(versions []string) {
 	bs.optionsCache = optsManifest
 }
 
-func NewServer(version string, gitUrl string, period time.Duration) *BuildServer {
+func NewServer(version string, gitUrl string, period time.Duration, webhookSecret string) *BuildServer {
 	execFolder, _ := osext.ExecutableFolder()
-	serv := &BuildServer{version: version, gitURL: gitUrl, pollPeriod: period, execFolder: execFolder}
+	serv := &BuildServer{version: version, gitURL: gitUrl, pollPeriod: period, execFolder: execFolder, webhookSecret: webhookSecret, wakeup: make(chan struct{}, 1)}
+	serv.jobs = jobs.NewQueue(execFolder+"/jobs", *workers, serv.runBuildJob)
+	serv.jobs.StartSweeper(jobSweepInterval, *jobTTL)
+	serv.builder = newBuilder(*builderKind, *builderImage)
+
+	serv.cacheDir = execFolder + "/cache"
+	serv.cacheSizeCap = *cacheSize
+	serv.cacheIndex = make(map[string]*cacheEntry)
+	serv.loadCacheIndex()
+
 	go serv.updateTags()
 	return serv
 }
@@ -143,11 +306,34 @@ func main() {
 	if *debugMode {
 		fmt.Println("Debug mode enabled")
 	}
-	server := NewServer(version, *gitRepo, *pollPeriod)
+
+	//With a webhook configured we don't need to hammer Github every few
+	//minutes - the webhook tells us when something changed. Only apply the
+	//relaxed default if the caller didn't pick their own -poll value.
+	period := *pollPeriod
+	if *webhookSecret != "" {
+		pollFlagSet := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "poll" {
+				pollFlagSet = true
+			}
+		})
+		if !pollFlagSet {
+			period = time.Hour
+		}
+	}
+
+	server := NewServer(version, *gitRepo, period, *webhookSecret)
 	router := mux.NewRouter()
 	router.HandleFunc("/", server.HomeHandler).Methods("GET")
 	router.HandleFunc("/options", server.OptionsHandler).Methods("GET")
 	router.HandleFunc("/build", server.BuildHandler).Methods("POST")
+	router.HandleFunc("/build/{id}", server.JobStatusHandler).Methods("GET")
+	router.HandleFunc("/build/{id}", server.JobCancelHandler).Methods("DELETE")
+	router.HandleFunc("/build/{id}/artifact", server.JobArtifactHandler).Methods("GET")
+	router.HandleFunc("/build/{id}/artifact/{name}", server.JobArtifactHandler).Methods("GET")
+	router.HandleFunc("/cache/stats", server.CacheStatsHandler).Methods("GET")
+	router.HandleFunc("/webhook/github", server.WebhookHandler).Methods("POST")
 	http.ListenAndServe(":8080", router)
 }
 
@@ -206,14 +392,250 @@ func (bs *BuildServer) OptionsHandler(rw http.ResponseWriter, req *http.Request)
 	rw.Write(opts)
 }
 
-func (bs *BuildServer) BuildHandler(rw http.ResponseWriter, req *http.Request) {
-	//Generate a unique folder name to execute the build in
-	// create a temp prefix with the requester addr, with '.' and ':' subbed
+// isStreamRequest determines whether the client asked for the ndjson
+// streaming response instead of the legacy single-blob JSON response.
+func isStreamRequest(req *http.Request) bool {
+	return req.Header.Get("Accept") == "application/x-ndjson" || req.URL.Query().Get("stream") == "1"
+}
+
+// flusher is satisfied by http.Flusher, but lets streamCmd also drive a
+// plain io.Writer (e.g. a job's on-disk log) via a no-op implementation.
+type flusher interface {
+	Flush()
+}
+
+type nopFlusher struct{}
+
+func (nopFlusher) Flush() {}
+
+// flushWriter flushes w (an http.Flusher) after every write, so a Builder's
+// internal ndjson log - otherwise only buffered for runBuildJob's on-disk
+// log - reaches a live streaming client as it's produced.
+type flushWriter struct {
+	w  io.Writer
+	fl http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.fl.Flush()
+	return n, err
+}
+
+// streamCmd runs cmd, JSON-encoding and flushing each chunk of stdout/stderr
+// to enc as it arrives, tagged with the given stream name ("clone",
+// "checkout", "cmake", "make", or "build" for a container build). If cancel is closed before cmd finishes,
+// the process is killed. It returns the combined output (so callers can
+// report a tail on error) and the error from running the command, if any.
+func streamCmd(enc *json.Encoder, fl flusher, stream string, cmd *exec.Cmd, cancel <-chan struct{}) ([]byte, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	if cancel != nil {
+		go func() {
+			select {
+			case <-cancel:
+				if cmd.Process != nil {
+					cmd.Process.Kill()
+				}
+			case <-done:
+			}
+		}()
+	}
+
+	var combined bytes.Buffer
+	var combinedMu sync.Mutex
+	var wg sync.WaitGroup
+
+	pump := func(r io.Reader) {
+		defer wg.Done()
+		buf := make([]byte, 4096)
+		for {
+			n, rerr := r.Read(buf)
+			if n > 0 {
+				chunk := make([]byte, n)
+				copy(chunk, buf[:n])
+
+				combinedMu.Lock()
+				combined.Write(chunk)
+				enc.Encode(map[string]string{"stream": stream, "chunk": string(chunk)})
+				fl.Flush()
+				combinedMu.Unlock()
+			}
+			if rerr != nil {
+				return
+			}
+		}
+	}
+
+	wg.Add(2)
+	go pump(stdout)
+	go pump(stderr)
+	wg.Wait()
+
+	err = cmd.Wait()
+	close(done)
+	return combined.Bytes(), err
+}
+
+// tail returns at most the last n bytes of b, as a string.
+func tail(b []byte, n int) string {
+	if len(b) > n {
+		b = b[len(b)-n:]
+	}
+	return string(b)
+}
+
+// exitCode extracts the process exit code from an error returned by
+// cmd.Wait(), defaulting to -1 if it isn't an *exec.ExitError.
+func exitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// eepromField describes where one build option lives in the EEPROM image,
+// as declared by eeprom.json in the BrewTroller source tree. Options with
+// no entry default to zero at build time.
+type eepromField struct {
+	Option string `json:"option"`
+	Offset int    `json:"offset"`
+	Type   string `json:"type"` // "uint8", "uint16", "bool" or "string"
+	Length int    `json:"length"`
+}
+
+// loadEepromLayout reads srcDir/eeprom.json. A missing file is not an error;
+// it yields an empty layout, so this BrewTroller version's EEPROM image
+// carries no data (its Intel HEX holds only the end-of-file record).
+func loadEepromLayout(srcDir string) ([]eepromField, error) {
+	raw, err := ioutil.ReadFile(path.Join(srcDir, EepromFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var layout []eepromField
+	if err := json.Unmarshal(raw, &layout); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// buildEepromImage renders layout against opts into a zero-filled EEPROM
+// image sized to the highest offset+length the layout describes. Options
+// the layout doesn't mention, or that aren't present in opts, are left zero.
+func buildEepromImage(layout []eepromField, opts map[string]interface{}) []byte {
+	size := 0
+	for _, f := range layout {
+		if end := f.Offset + f.Length; end > size {
+			size = end
+		}
+	}
+	img := make([]byte, size)
+
+	for _, f := range layout {
+		v, found := opts[f.Option]
+		if !found || f.Length <= 0 || f.Offset+f.Length > len(img) {
+			continue
+		}
+		switch f.Type {
+		case "bool":
+			if b, ok := v.(bool); ok && b {
+				img[f.Offset] = 1
+			}
+		case "uint8":
+			img[f.Offset] = byte(eepromInt(v))
+		case "uint16":
+			n := eepromInt(v)
+			img[f.Offset] = byte(n)
+			img[f.Offset+1] = byte(n >> 8)
+		case "string":
+			if s, ok := v.(string); ok {
+				copy(img[f.Offset:f.Offset+f.Length], s)
+			}
+		}
+	}
+	return img
+}
+
+// eepromInt coerces a decoded JSON option value (float64, string or int) to
+// an int, defaulting to 0 if it can't be parsed as a number.
+func eepromInt(v interface{}) int {
+	switch n := v.(type) {
+	case float64:
+		return int(n)
+	case int:
+		return n
+	case string:
+		i, _ := strconv.Atoi(n)
+		return i
+	}
+	return 0
+}
+
+// intelHexEncode renders data as an Intel HEX text file: 16-byte data
+// records followed by the standard end-of-file record.
+func intelHexEncode(data []byte) string {
+	var out bytes.Buffer
+	for offset := 0; offset < len(data); offset += 16 {
+		end := offset + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		rec := data[offset:end]
+
+		sum := len(rec) + (offset>>8)&0xFF + offset&0xFF
+		fmt.Fprintf(&out, ":%02X%04X00", len(rec), offset)
+		for _, b := range rec {
+			fmt.Fprintf(&out, "%02X", b)
+			sum += int(b)
+		}
+		fmt.Fprintf(&out, "%02X\n", byte(0x100-(sum&0xFF)))
+	}
+	out.WriteString(":00000001FF\n")
+	return out.String()
+}
+
+// artifactDescriptor describes a build output inline, base64-encoding its
+// bytes directly into the response.
+func artifactDescriptor(format string, data []byte) map[string]interface{} {
+	sum := sha256.Sum256(data)
+	return map[string]interface{}{
+		"format": format,
+		"size":   len(data),
+		"sha256": hex.EncodeToString(sum[:]),
+		"data":   base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+// artifactDescriptorURL describes a build output by reference, for callers
+// that already have a job id and would rather fetch the artifact separately.
+func artifactDescriptorURL(meta jobs.ArtifactMeta, url string) map[string]interface{} {
+	return map[string]interface{}{
+		"format": meta.Format,
+		"size":   meta.Size,
+		"sha256": meta.Sha256,
+		"url":    url,
+	}
+}
+
+func (bs *BuildServer) streamBuildHandler(rw http.ResponseWriter, req *http.Request) {
 	reqID := strings.Replace(req.RemoteAddr, ".", "_", -1)
 	reqID = strings.Replace(reqID, ":", "-", -1) + "-"
 	tempDir, err := ioutil.TempDir("", reqID)
-
-	//Handle error making temp build directory
 	if err != nil {
 		errResp := makeErrorResonse("500", err)
 		rw.Header().Add("Access-Control-Allow-Origin", "*")
@@ -221,9 +643,164 @@ func (bs *BuildServer) BuildHandler(rw http.ResponseWriter, req *http.Request) {
 		rw.Write(errResp)
 		return
 	}
-	//Clean-up the temp dir
 	defer os.RemoveAll(tempDir)
 
+	reqData, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		errResp := makeErrorResonse("500", err)
+		rw.Header().Add("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(errResp)
+		return
+	}
+
+	optsMap := make(map[string]interface{})
+	err = json.Unmarshal(reqData, &optsMap)
+	if err != nil {
+		errResp := makeErrorResonse("400", err)
+		rw.Header().Add("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write(errResp)
+		return
+	}
+
+	board, found := optsMap["board"].(string)
+	if !found {
+		errResp := makeErrorResonse("400", errors.New("Board Option Must be Supplied!"))
+		rw.Header().Add("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write(errResp)
+		return
+	}
+
+	buildVer, found := optsMap["BuildVersion"].(string)
+	if !found {
+		errResp := makeErrorResonse("400", errors.New("Build Version Must be Supplied!"))
+		rw.Header().Add("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write(errResp)
+		return
+	}
+
+	bs.mu.RLock()
+	_, validVer := bs.optionsCache[buildVer]
+	bs.mu.RUnlock()
+	if !validVer {
+		errResp := makeErrorResonse("400", errors.New("Build Version "+buildVer+" is invalid!"))
+		rw.Header().Add("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write(errResp)
+		return
+	}
+
+	delete(optsMap, "BuildVersion")
+
+	cmakeOpts := make([]string, 0, 20)
+	for k, v := range optsMap {
+		switch val := v.(type) {
+		case string:
+			cmakeOpts = append(cmakeOpts, fmt.Sprintf("-D%s=%s", k, val))
+		case int:
+			cmakeOpts = append(cmakeOpts, fmt.Sprintf("-D%s=%d", k, val))
+		}
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		errResp := makeErrorResonse("500", errors.New("streaming not supported by this response writer"))
+		rw.Header().Add("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(errResp)
+		return
+	}
+
+	rw.Header().Add("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(rw)
+
+	fail := func(stream string, out []byte, err error) {
+		enc.Encode(map[string]interface{}{
+			"stream": stream,
+			"type":   "error",
+			"code":   exitCode(err),
+			"chunk":  tail(out, 4000),
+		})
+		flusher.Flush()
+	}
+
+	// Bound the whole build by *buildTimeout, same as runBuildJob, and kill
+	// whatever's running the moment the client disconnects - req.Context()
+	// is canceled by net/http as soon as the connection goes away.
+	ctx, cancelCtx := context.WithTimeout(req.Context(), *buildTimeout)
+	defer cancelCtx()
+
+	pathToSource := bs.execFolder + SourceDir
+	bs.mu.RLock()
+	cloneOut, err := streamCmd(enc, flusher, "clone", exec.CommandContext(ctx, "git", "clone", pathToSource, tempDir), nil)
+	bs.mu.RUnlock()
+	if err != nil {
+		fail("clone", cloneOut, err)
+		return
+	}
+
+	checkoutCmd := exec.CommandContext(ctx, "git", "checkout", buildVer)
+	checkoutCmd.Dir = tempDir
+	checkoutOut, err := streamCmd(enc, flusher, "checkout", checkoutCmd, nil)
+	if err != nil {
+		fail("checkout", checkoutOut, err)
+		return
+	}
+
+	optionsPath := path.Join(tempDir, "user_config.json")
+	if err = ioutil.WriteFile(optionsPath, reqData, 0644); err != nil {
+		fail("checkout", nil, err)
+		return
+	}
+
+	// Run cmake+make through the same pluggable, sandboxable Builder the
+	// async job path uses, instead of invoking them directly against the
+	// host - an attacker-controlled -D option never reaches a bare host
+	// cmake just because the client asked for ?stream=1.
+	result, err := bs.builder.Build(ctx, tempDir, BuildOptions{Board: board, CmakeDefines: cmakeOpts}, flushWriter{w: rw, fl: flusher})
+	if err != nil {
+		fail("build", nil, err)
+		return
+	}
+	binary := result.Binary
+
+	eepromLayout, err := loadEepromLayout(tempDir)
+	if err != nil {
+		fail("make", nil, err)
+		return
+	}
+	eepromImage := []byte(intelHexEncode(buildEepromImage(eepromLayout, optsMap)))
+
+	sum := sha256.Sum256(binary)
+	enc.Encode(map[string]interface{}{
+		"type":        "result",
+		"binary":      string(binary),
+		"sha256":      hex.EncodeToString(sum[:]),
+		"size":        len(binary),
+		"flash":       artifactDescriptor("ihex", binary),
+		"eeprom":      artifactDescriptor("ihex", eepromImage),
+		"user_config": artifactDescriptor("raw", reqData),
+	})
+	flusher.Flush()
+}
+
+// BuildHandler enqueues a build and returns immediately. The ?stream=1 /
+// Accept: application/x-ndjson mode is the one exception: it still runs the
+// build inline on this connection so the caller can watch it live without
+// having to poll the job endpoints below.
+func (bs *BuildServer) BuildHandler(rw http.ResponseWriter, req *http.Request) {
+	if isStreamRequest(req) {
+		bs.streamBuildHandler(rw, req)
+		return
+	}
+
 	//Get request data
 	reqData, err := ioutil.ReadAll(req.Body)
 
@@ -250,8 +827,7 @@ func (bs *BuildServer) BuildHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	//Ensure we have a board option
-	board, found := optsMap["board"].(string)
-	if !found {
+	if _, found := optsMap["board"].(string); !found {
 		err := errors.New("Board Option Must be Supplied!")
 		errResp := makeErrorResonse("400", err)
 		rw.Header().Add("Access-Control-Allow-Origin", "*")
@@ -283,82 +859,221 @@ func (bs *BuildServer) BuildHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	//Remove the build version from the opts map, as CMake cannot use it
+	//If we've already built this exact option set against this commit, skip
+	//the queue entirely and hand back the cached artifact.
+	if cacheKey, err := bs.buildCacheKey(optsMap); err == nil {
+		if hit, found := bs.cacheLookup(cacheKey); found {
+			resp := map[string]interface{}{
+				"binary": string(hit.Binary),
+				"sha256": hit.BinarySha256,
+				"cache":  "hit",
+				"flash":  artifactDescriptor("ihex", hit.Binary),
+			}
+			if hit.Eeprom != nil {
+				resp["eeprom"] = artifactDescriptor("ihex", hit.Eeprom)
+			}
+			if hit.UserConfig != nil {
+				resp["user_config"] = artifactDescriptor("raw", hit.UserConfig)
+			}
+			enc, _ := json.Marshal(resp)
+			rw.Header().Add("Content-Type", "application/json")
+			rw.Header().Add("Access-Control-Allow-Origin", "*")
+			rw.Write(enc)
+			return
+		}
+	}
+
+	job, err := bs.jobs.Enqueue(optsMap)
+	if err == jobs.ErrQueueFull {
+		errResp := makeErrorResonse("503", err)
+		rw.Header().Add("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write(errResp)
+		return
+	}
+	if err != nil {
+		errResp := makeErrorResonse("500", err)
+		rw.Header().Add("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(errResp)
+		return
+	}
+
+	// job is the live *jobs.Job the worker pool may already be mutating;
+	// re-fetch it through Get for a safe, lock-protected copy of Status
+	// instead of reading the racy pointer directly.
+	status := jobs.StatusQueued
+	if safe, found := bs.jobs.Get(job.ID); found {
+		status = safe.Status
+	}
+
+	resp := map[string]string{"id": job.ID, "status": string(status)}
+	enc, _ := json.Marshal(resp)
+	rw.Header().Add("Content-Type", "application/json")
+	rw.Header().Add("Access-Control-Allow-Origin", "*")
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(enc)
+}
+
+// runBuildJob is the jobs.BuildFunc run by the worker pool for every queued
+// build. It performs the same clone/checkout/cmake/make sequence the old
+// synchronous BuildHandler used to run inline, writing an ndjson progress
+// log to w as it goes.
+func (bs *BuildServer) runBuildJob(job *jobs.Job, w io.Writer, cancel <-chan struct{}) (map[string]jobs.Artifact, error) {
+	var logBuf bytes.Buffer
+	logDest := io.MultiWriter(w, &logBuf)
+	enc := json.NewEncoder(logDest)
+
+	board, _ := job.Options["board"].(string)
+	version, _ := job.Options["BuildVersion"].(string)
+
+	optsMap := make(map[string]interface{}, len(job.Options))
+	for k, v := range job.Options {
+		optsMap[k] = v
+	}
 	delete(optsMap, "BuildVersion")
 
-	//Make a slice to hold the options, with an init len of 0 and a capacity of 20
-	//   we start with a capacity of 20 to prevent having to initialize a new slice after every append
 	cmakeOpts := make([]string, 0, 20)
-	//iterate through the build options requested and make a slice to pass to cmake
 	for k, v := range optsMap {
 		switch val := v.(type) {
-        case string:
-                opt := fmt.Sprintf("-D%s=%s", k, val)
-                cmakeOpts = append(cmakeOpts, opt)
-        case int:
-                opt := fmt.Sprintf("-D%s=%d", k, val)
-                cmakeOpts = append(cmakeOpts, opt)
-        }
-	}
-	//Append the absolute path to the brewtroller source directory
-	cmakeOpts = append(cmakeOpts, tempDir)
-
-	//Clone the source repo into the temp dir
+		case string:
+			cmakeOpts = append(cmakeOpts, fmt.Sprintf("-D%s=%s", k, val))
+		case int:
+			cmakeOpts = append(cmakeOpts, fmt.Sprintf("-D%s=%d", k, val))
+		}
+	}
+
+	reqID := "job-" + job.ID + "-"
+	tempDir, err := ioutil.TempDir("", reqID)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Enforce a wall-clock deadline on the whole build, and make sure a
+	// canceled job actually kills whatever subprocess is running.
+	ctx, cancelCtx := context.WithTimeout(context.Background(), *buildTimeout)
+	defer cancelCtx()
+	go func() {
+		select {
+		case <-cancel:
+			cancelCtx()
+		case <-ctx.Done():
+		}
+	}()
+
 	pathToSource := bs.execFolder + SourceDir
-	cloneCmd := exec.Command("git", "clone", pathToSource, tempDir)
 	bs.mu.RLock()
-	cloneCmd.Run()
+	_, err = streamCmd(enc, nopFlusher{}, "clone", exec.CommandContext(ctx, "git", "clone", pathToSource, tempDir), nil)
 	bs.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
 
-	//Checkout the build version in the temp dir
-	checkoutCmd := exec.Command("git", "checkout", version)
+	checkoutCmd := exec.CommandContext(ctx, "git", "checkout", version)
 	checkoutCmd.Dir = tempDir
-	checkoutCmd.Run()
-	//Create the build dir
-	buildDir := path.Join(tempDir, "/build")
-	os.MkdirAll(buildDir, 0777)
-
-        // Save copy of settings to build directory
-        optionsPath := path.Join(tempDir,"user_config.json")
-
-        err = ioutil.WriteFile(optionsPath, reqData, 0644)
-        if err != nil {
-               errResp := makeErrorResonse("500", err)
-               rw.Header().Add("Access-Control-Allow-Origin", "*")
-               rw.WriteHeader(http.StatusInternalServerError)
-               rw.Write(errResp)
-               return
-        }
-
-	//Attempt to setup Cmake build dir
-	cmakeCmd := exec.Command("cmake", cmakeOpts...)
-	cmakeCmd.Dir = buildDir
+	if _, err = streamCmd(enc, nopFlusher{}, "checkout", checkoutCmd, nil); err != nil {
+		return nil, err
+	}
+
+	// Save copy of settings to build directory
+	optionsJSON, _ := json.Marshal(job.Options)
+	if err = ioutil.WriteFile(path.Join(tempDir, "user_config.json"), optionsJSON, 0644); err != nil {
+		return nil, err
+	}
+
+	result, err := bs.builder.Build(ctx, tempDir, BuildOptions{Board: board, CmakeDefines: cmakeOpts}, logDest)
+	if err != nil {
+		return nil, err
+	}
+	binary := result.Binary
 
-	cmakeOut, err := cmakeCmd.CombinedOutput()
-	//Handle cmake setup error
+	eepromLayout, err := loadEepromLayout(tempDir)
 	if err != nil {
-		errResp := makeErrorResonse("500", err, string(cmakeOut))
+		return nil, err
+	}
+	eepromImage := []byte(intelHexEncode(buildEepromImage(eepromLayout, optsMap)))
+
+	sum := sha256.Sum256(binary)
+	enc.Encode(map[string]interface{}{
+		"type":   "result",
+		"sha256": hex.EncodeToString(sum[:]),
+		"size":   len(binary),
+	})
+
+	if cacheKey, cerr := bs.buildCacheKey(job.Options); cerr == nil {
+		bs.cacheStore(cacheKey, optsMap, binary, eepromImage, optionsJSON, logBuf.String())
+	}
+
+	return map[string]jobs.Artifact{
+		"flash":       {Format: "ihex", Data: binary},
+		"eeprom":      {Format: "ihex", Data: eepromImage},
+		"user_config": {Format: "raw", Data: optionsJSON},
+	}, nil
+}
+
+// JobStatusHandler reports a build job's status and progress log.
+func (bs *BuildServer) JobStatusHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	job, found := bs.jobs.Get(id)
+	if !found {
+		errResp := makeErrorResonse("400", errors.New("Job "+id+" not found"))
 		rw.Header().Add("Access-Control-Allow-Origin", "*")
-		rw.WriteHeader(http.StatusInternalServerError)
+		rw.WriteHeader(http.StatusNotFound)
 		rw.Write(errResp)
 		return
 	}
 
-	//build the image(s) -- in the future we will build an eeprom image to upload
-	makeCmd := exec.Command("make")
-	makeCmd.Dir = buildDir
-	makeOut, err := makeCmd.CombinedOutput()
-	//Handle any errors from make
-	if err != nil {
-		errResp := makeErrorResonse("500", err, string(makeOut))
+	logBytes, _ := ioutil.ReadFile(bs.jobs.LogPath(id))
+
+	resp := map[string]interface{}{
+		"id":     job.ID,
+		"status": job.Status,
+		"log":    string(logBytes),
+	}
+	if job.Error != "" {
+		resp["error"] = job.Error
+	}
+	for _, name := range []string{"flash", "eeprom", "user_config"} {
+		if meta, ok := job.Artifacts[name]; ok {
+			resp[name] = artifactDescriptorURL(meta, "/build/"+id+"/artifact/"+name)
+		}
+	}
+
+	enc, _ := json.Marshal(resp)
+	rw.Header().Add("Content-Type", "application/json")
+	rw.Header().Add("Access-Control-Allow-Origin", "*")
+	rw.Write(enc)
+}
+
+// JobArtifactHandler streams one of a finished job's named artifacts
+// ("flash", "eeprom" or "user_config"). The bare /build/{id}/artifact route
+// is kept as an alias for "flash" for clients written before EEPROM and
+// user_config artifacts existed.
+func (bs *BuildServer) JobArtifactHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	name := mux.Vars(req)["name"]
+	if name == "" {
+		name = "flash"
+	}
+
+	job, found := bs.jobs.Get(id)
+	if !found {
+		errResp := makeErrorResonse("400", errors.New("Job "+id+" not found"))
 		rw.Header().Add("Access-Control-Allow-Origin", "*")
-		rw.WriteHeader(http.StatusInternalServerError)
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write(errResp)
+		return
+	}
+	if _, ok := job.Artifacts[name]; !ok {
+		errResp := makeErrorResonse("400", errors.New("Job "+id+" has no "+name+" artifact"))
+		rw.Header().Add("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusNotFound)
 		rw.Write(errResp)
 		return
 	}
 
-	//Grab the binary and read it
-	binary, err := ioutil.ReadFile(buildDir + "/src/BrewTroller-" + board + ".hex")
+	binary, err := ioutil.ReadFile(bs.jobs.ArtifactPath(id, name))
 	if err != nil {
 		errResp := makeErrorResonse("500", err)
 		rw.Header().Add("Access-Control-Allow-Origin", "*")
@@ -367,21 +1082,343 @@ func (bs *BuildServer) BuildHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	//Create response map
-	resp := make(map[string]string)
+	rw.Header().Add("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(binary)))
+	rw.Write(binary)
+}
 
-	if *debugMode {
-		resp["reqID"] = reqID
-		resp["buildLocation"] = tempDir
-		resp["reqDat"] = string(reqData)
-		resp["cmake-output"] = string(cmakeOut)
-		resp["make-output"] = string(makeOut)
+// JobCancelHandler cancels a queued or running build job.
+func (bs *BuildServer) JobCancelHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bs.jobs.Cancel(id) {
+		errResp := makeErrorResonse("400", errors.New("Job "+id+" not found"))
+		rw.Header().Add("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write(errResp)
+		return
+	}
+
+	rw.Header().Add("Access-Control-Allow-Origin", "*")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// canonicalJSON encodes m with its keys sorted, so the same option set always
+// hashes to the same bytes regardless of map iteration order.
+func canonicalJSON(m map[string]interface{}) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
-	resp["binary"] = string(binary)
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		buf.Write(kb)
+		buf.WriteByte(':')
+		vb, _ := json.Marshal(m[k])
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
 
-	enc, _ := json.Marshal(resp)
+// resolveCommit resolves a tag/branch/ref in the shared source checkout to
+// the git commit SHA it currently points at.
+func (bs *BuildServer) resolveCommit(ref string) (string, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	cmd := exec.Command("git", "rev-parse", ref)
+	cmd.Dir = bs.execFolder + SourceDir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// buildCacheKey hashes the options a build was requested with (minus
+// BuildVersion) together with the resolved commit SHA for BuildVersion, so
+// identical requests against the same commit always collide on one entry.
+func (bs *BuildServer) buildCacheKey(fullOpts map[string]interface{}) (string, error) {
+	version, _ := fullOpts["BuildVersion"].(string)
+	commitSHA, err := bs.resolveCommit(version)
+	if err != nil {
+		return "", err
+	}
+
+	opts := make(map[string]interface{}, len(fullOpts))
+	for k, v := range fullOpts {
+		if k == "BuildVersion" {
+			continue
+		}
+		opts[k] = v
+	}
+
+	h := sha256.New()
+	h.Write(canonicalJSON(opts))
+	h.Write([]byte(commitSHA))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (bs *BuildServer) cacheHexPath(key string) string {
+	return path.Join(bs.cacheDir, key+".hex")
+}
+
+func (bs *BuildServer) cacheEepromPath(key string) string {
+	return path.Join(bs.cacheDir, key+".eeprom.hex")
+}
+
+func (bs *BuildServer) cacheUserConfigPath(key string) string {
+	return path.Join(bs.cacheDir, key+".user_config.json")
+}
+
+func (bs *BuildServer) cacheMetaPath(key string) string {
+	return path.Join(bs.cacheDir, key+".meta.json")
+}
+
+// loadCacheIndex rebuilds the in-memory cache index from the .meta.json
+// files already on disk, so a restart doesn't forget what's cached.
+func (bs *BuildServer) loadCacheIndex() {
+	os.MkdirAll(bs.cacheDir, 0755)
+	files, err := ioutil.ReadDir(bs.cacheDir)
+	if err != nil {
+		return
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".meta.json") {
+			continue
+		}
+		raw, err := ioutil.ReadFile(path.Join(bs.cacheDir, f.Name()))
+		if err != nil {
+			continue
+		}
+		var entry cacheEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			continue
+		}
+		bs.cacheIndex[entry.Sha] = &entry
+	}
+}
+
+// saveCacheMeta persists entry's metadata. Callers must hold bs.mu.
+func (bs *BuildServer) saveCacheMeta(entry *cacheEntry) {
+	enc, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return
+	}
+	ioutil.WriteFile(bs.cacheMetaPath(entry.Sha), enc, 0644)
+}
+
+// cacheHit is the payload handed back by cacheLookup on a hit. Eeprom and
+// UserConfig are nil if the entry predates those artifacts being cached, or
+// if their cached files can no longer be read. A build with no eeprom.json
+// still caches an Eeprom image, holding only the end-of-file record.
+type cacheHit struct {
+	Binary           []byte
+	BinarySha256     string
+	Eeprom           []byte
+	EepromSha256     string
+	UserConfig       []byte
+	UserConfigSha256 string
+}
+
+// cacheLookup returns the cached artifacts for key, if present, bumping the
+// entry's access time for LRU purposes.
+func (bs *BuildServer) cacheLookup(key string) (cacheHit, bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	entry, found := bs.cacheIndex[key]
+	if !found {
+		bs.cacheMisses++
+		return cacheHit{}, false
+	}
+
+	binary, err := ioutil.ReadFile(bs.cacheHexPath(key))
+	if err != nil {
+		delete(bs.cacheIndex, key)
+		bs.cacheMisses++
+		return cacheHit{}, false
+	}
+
+	hit := cacheHit{Binary: binary, BinarySha256: entry.BinarySha256}
+	if entry.EepromSha256 != "" {
+		if eeprom, err := ioutil.ReadFile(bs.cacheEepromPath(key)); err == nil {
+			hit.Eeprom = eeprom
+			hit.EepromSha256 = entry.EepromSha256
+		}
+	}
+	if entry.UserConfigSha256 != "" {
+		if userConfig, err := ioutil.ReadFile(bs.cacheUserConfigPath(key)); err == nil {
+			hit.UserConfig = userConfig
+			hit.UserConfigSha256 = entry.UserConfigSha256
+		}
+	}
+
+	entry.AccessedAt = time.Now()
+	bs.saveCacheMeta(entry)
+	bs.cacheHits++
+	return hit, true
+}
+
+// cacheStore writes a freshly built flash image, EEPROM image (if any) and
+// user_config.json into the cache, and evicts the least-recently-used
+// entries until the cache fits within cacheSizeCap.
+func (bs *BuildServer) cacheStore(key string, opts map[string]interface{}, binary, eepromImage, userConfig []byte, log string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if err := ioutil.WriteFile(bs.cacheHexPath(key), binary, 0644); err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(binary)
+	now := time.Now()
+	entry := &cacheEntry{
+		Sha:          key,
+		BinarySha256: hex.EncodeToString(sum[:]),
+		Options:      opts,
+		Log:          log,
+		Size:         int64(len(binary)),
+		CreatedAt:    now,
+		AccessedAt:   now,
+	}
+
+	if len(eepromImage) > 0 && ioutil.WriteFile(bs.cacheEepromPath(key), eepromImage, 0644) == nil {
+		eepromSum := sha256.Sum256(eepromImage)
+		entry.EepromSha256 = hex.EncodeToString(eepromSum[:])
+		entry.EepromSize = int64(len(eepromImage))
+	}
+	if len(userConfig) > 0 && ioutil.WriteFile(bs.cacheUserConfigPath(key), userConfig, 0644) == nil {
+		userConfigSum := sha256.Sum256(userConfig)
+		entry.UserConfigSha256 = hex.EncodeToString(userConfigSum[:])
+		entry.UserConfigSize = int64(len(userConfig))
+	}
+
+	bs.cacheIndex[key] = entry
+	bs.saveCacheMeta(entry)
+	bs.evictToFitLocked()
+}
+
+// evictToFitLocked removes the least-recently-accessed cache entries until
+// the total cached size is within cacheSizeCap. Callers must hold bs.mu.
+func (bs *BuildServer) evictToFitLocked() {
+	var total int64
+	for _, e := range bs.cacheIndex {
+		total += e.Size + e.EepromSize + e.UserConfigSize
+	}
+
+	for total > bs.cacheSizeCap {
+		var oldestKey string
+		var oldest time.Time
+		for k, e := range bs.cacheIndex {
+			if oldestKey == "" || e.AccessedAt.Before(oldest) {
+				oldestKey, oldest = k, e.AccessedAt
+			}
+		}
+		if oldestKey == "" {
+			return
+		}
+
+		victim := bs.cacheIndex[oldestKey]
+		total -= victim.Size + victim.EepromSize + victim.UserConfigSize
+		os.Remove(bs.cacheHexPath(oldestKey))
+		os.Remove(bs.cacheMetaPath(oldestKey))
+		os.Remove(bs.cacheEepromPath(oldestKey))
+		os.Remove(bs.cacheUserConfigPath(oldestKey))
+		delete(bs.cacheIndex, oldestKey)
+	}
+}
+
+// CacheStatsHandler reports build cache hit/miss counters and utilization.
+func (bs *BuildServer) CacheStatsHandler(rw http.ResponseWriter, req *http.Request) {
+	bs.mu.RLock()
+	var bytesUsed int64
+	for _, e := range bs.cacheIndex {
+		bytesUsed += e.Size + e.EepromSize + e.UserConfigSize
+	}
+	stats := map[string]interface{}{
+		"hits":    bs.cacheHits,
+		"misses":  bs.cacheMisses,
+		"entries": len(bs.cacheIndex),
+		"bytes":   bytesUsed,
+	}
+	bs.mu.RUnlock()
+
+	enc, _ := json.Marshal(stats)
 	rw.Header().Add("Content-Type", "application/json")
 	rw.Header().Add("Access-Control-Allow-Origin", "*")
 	rw.Write(enc)
 }
+
+// validGithubSignature checks header (the X-Hub-Signature-256 value) against
+// an HMAC-SHA256 of body keyed by secret, in constant time.
+func validGithubSignature(secret string, body []byte, header string) bool {
+	const prefix = "sha256="
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	sig, err := hex.DecodeString(header[len(prefix):])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// triggerRefresh wakes the poll worker up to run a refresh immediately,
+// without blocking if one is already pending.
+func (bs *BuildServer) triggerRefresh() {
+	select {
+	case bs.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// WebhookHandler validates a Github webhook delivery and, for push or tag
+// creation events, wakes the poll worker so the new tags show up without
+// waiting for the next scheduled poll.
+func (bs *BuildServer) WebhookHandler(rw http.ResponseWriter, req *http.Request) {
+	if bs.webhookSecret == "" {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !validGithubSignature(bs.webhookSecret, body, req.Header.Get("X-Hub-Signature-256")) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var payload struct {
+		RefType string `json:"ref_type"`
+	}
+	json.Unmarshal(body, &payload)
+
+	switch req.Header.Get("X-GitHub-Event") {
+	case "push":
+		bs.triggerRefresh()
+	case "create":
+		if payload.RefType == "tag" {
+			bs.triggerRefresh()
+		}
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,342 @@
+// Package jobs implements a small bounded worker pool for running builds
+// asynchronously and tracking their state (options, log, artifact, timings)
+// on disk so results survive past the client's original connection.
+package jobs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by Enqueue when the worker pool is backed up and
+// can't accept another job right now.
+var ErrQueueFull = errors.New("job queue is full")
+
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusCanceled  Status = "canceled"
+)
+
+// Job describes the state of a single enqueued build.
+type Job struct {
+	ID         string                 `json:"id"`
+	Status     Status                 `json:"status"`
+	Options    map[string]interface{} `json:"options"`
+	Error      string                 `json:"error,omitempty"`
+	CreatedAt  time.Time              `json:"createdAt"`
+	StartedAt  time.Time              `json:"startedAt,omitempty"`
+	FinishedAt time.Time              `json:"finishedAt,omitempty"`
+
+	Artifacts map[string]ArtifactMeta `json:"artifacts,omitempty"`
+}
+
+// Artifact is one named output of a build, such as the flash image, the
+// EEPROM image, or the user_config.json it was built from.
+type Artifact struct {
+	Format string
+	Data   []byte
+}
+
+// ArtifactMeta is the persisted, size/checksum-only record of an Artifact;
+// the bytes themselves live on disk under the job's artifact directory.
+type ArtifactMeta struct {
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// BuildFunc performs the actual build for a job, writing a progress log to
+// w as it goes. cancel is closed if the client asks to cancel the job before
+// it finishes. On success it returns the build's named artifacts.
+type BuildFunc func(job *Job, w io.Writer, cancel <-chan struct{}) (map[string]Artifact, error)
+
+// Queue is a bounded worker pool that runs jobs via a BuildFunc and persists
+// job state under dir/<id>/.
+type Queue struct {
+	dir   string
+	build BuildFunc
+	work  chan *Job
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	cancels map[string]chan struct{}
+}
+
+// NewQueue starts a pool of workers consuming from an internal job channel.
+func NewQueue(dir string, workers int, build BuildFunc) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+	os.MkdirAll(dir, 0755)
+	q := &Queue{
+		dir:     dir,
+		build:   build,
+		work:    make(chan *Job, 64),
+		jobs:    make(map[string]*Job),
+		cancels: make(map[string]chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+func (q *Queue) worker() {
+	for job := range q.work {
+		q.run(job)
+	}
+}
+
+func (q *Queue) jobDir(id string) string {
+	return filepath.Join(q.dir, id)
+}
+
+// ArtifactPath returns the on-disk location of one of a finished job's named
+// artifacts (e.g. "flash", "eeprom", "user_config").
+func (q *Queue) ArtifactPath(id, name string) string {
+	return filepath.Join(q.jobDir(id), "artifacts", name)
+}
+
+// LogPath returns the on-disk location of a job's build log.
+func (q *Queue) LogPath(id string) string {
+	return filepath.Join(q.jobDir(id), "build.log")
+}
+
+func (q *Queue) run(job *Job) {
+	q.mu.Lock()
+	cancel := q.cancels[job.ID]
+	q.mu.Unlock()
+
+	select {
+	case <-cancel:
+		q.finish(job, StatusCanceled, nil, errors.New("canceled before start"))
+		return
+	default:
+	}
+
+	q.mu.Lock()
+	job.Status = StatusRunning
+	job.StartedAt = time.Now()
+	q.mu.Unlock()
+	q.save(job)
+
+	logFile, err := os.Create(q.LogPath(job.ID))
+	if err != nil {
+		q.finish(job, StatusFailed, nil, err)
+		return
+	}
+	defer logFile.Close()
+
+	artifacts, err := q.runBuild(job, logFile, cancel)
+	if err != nil {
+		select {
+		case <-cancel:
+			q.finish(job, StatusCanceled, artifacts, err)
+		default:
+			q.finish(job, StatusFailed, artifacts, err)
+		}
+		return
+	}
+	q.finish(job, StatusSucceeded, artifacts, nil)
+}
+
+// runBuild calls q.build, recovering from any panic so a single bad job
+// (e.g. a malformed option tripping an unchecked type assertion) can't take
+// the whole process down with it.
+func (q *Queue) runBuild(job *Job, w io.Writer, cancel <-chan struct{}) (artifacts map[string]Artifact, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			artifacts = nil
+			err = fmt.Errorf("build panicked: %v", r)
+		}
+	}()
+	return q.build(job, w, cancel)
+}
+
+func (q *Queue) finish(job *Job, status Status, artifacts map[string]Artifact, err error) {
+	q.mu.Lock()
+	job.Status = status
+	job.FinishedAt = time.Now()
+	if err != nil {
+		job.Error = err.Error()
+	}
+	q.mu.Unlock()
+
+	if len(artifacts) > 0 {
+		os.MkdirAll(filepath.Join(q.jobDir(job.ID), "artifacts"), 0755)
+		names := make([]string, 0, len(artifacts))
+		for name := range artifacts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		meta := make(map[string]ArtifactMeta, len(names))
+		for _, name := range names {
+			a := artifacts[name]
+			if werr := ioutil.WriteFile(q.ArtifactPath(job.ID, name), a.Data, 0644); werr != nil {
+				continue
+			}
+			sum := sha256.Sum256(a.Data)
+			meta[name] = ArtifactMeta{Format: a.Format, Size: int64(len(a.Data)), Sha256: hex.EncodeToString(sum[:])}
+		}
+		q.mu.Lock()
+		job.Artifacts = meta
+		q.mu.Unlock()
+	}
+	q.save(job)
+}
+
+func (q *Queue) save(job *Job) {
+	q.mu.Lock()
+	enc, err := json.MarshalIndent(job, "", "  ")
+	q.mu.Unlock()
+	if err != nil {
+		return
+	}
+	ioutil.WriteFile(filepath.Join(q.jobDir(job.ID), "job.json"), enc, 0644)
+}
+
+// copyJob returns a deep copy of job, safe to hand to a caller outside of
+// q.mu. Callers must hold q.mu while calling this.
+func copyJob(job *Job) *Job {
+	cp := *job
+
+	if job.Options != nil {
+		cp.Options = make(map[string]interface{}, len(job.Options))
+		for k, v := range job.Options {
+			cp.Options[k] = v
+		}
+	}
+	if job.Artifacts != nil {
+		cp.Artifacts = make(map[string]ArtifactMeta, len(job.Artifacts))
+		for k, v := range job.Artifacts {
+			cp.Artifacts[k] = v
+		}
+	}
+	return &cp
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Enqueue creates a new job for opts and schedules it to run on the worker
+// pool, returning immediately with the job in StatusQueued.
+func (q *Queue) Enqueue(opts map[string]interface{}) (*Job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{ID: id, Status: StatusQueued, Options: opts, CreatedAt: time.Now()}
+
+	if err := os.MkdirAll(q.jobDir(job.ID), 0755); err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	q.jobs[job.ID] = job
+	q.cancels[job.ID] = make(chan struct{})
+	q.mu.Unlock()
+
+	q.save(job)
+
+	// A non-blocking send: if the queue is backed up, fail the request
+	// instead of hanging the caller's goroutine until a worker frees up.
+	select {
+	case q.work <- job:
+	default:
+		q.mu.Lock()
+		delete(q.jobs, job.ID)
+		delete(q.cancels, job.ID)
+		q.mu.Unlock()
+		os.RemoveAll(q.jobDir(job.ID))
+		return nil, ErrQueueFull
+	}
+	return job, nil
+}
+
+// Get looks up a job by ID, returning a snapshot safe to read without
+// racing the worker goroutine that may still be mutating the original.
+func (q *Queue) Get(id string) (*Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, found := q.jobs[id]
+	if !found {
+		return nil, false
+	}
+	return copyJob(job), true
+}
+
+// Cancel signals a queued or running job to stop. It reports whether the job
+// was found; it does not guarantee the job has stopped by the time it returns.
+func (q *Queue) Cancel(id string) bool {
+	q.mu.Lock()
+	cancel, found := q.cancels[id]
+	job := q.jobs[id]
+	wasQueued := found && job.Status == StatusQueued
+	q.mu.Unlock()
+	if !found {
+		return false
+	}
+
+	select {
+	case <-cancel:
+		// already canceled
+	default:
+		close(cancel)
+	}
+
+	if wasQueued {
+		q.finish(job, StatusCanceled, nil, errors.New("canceled by client"))
+	}
+	return true
+}
+
+// Sweep removes the on-disk and in-memory state of finished jobs whose
+// FinishedAt is older than maxAge.
+func (q *Queue) Sweep(maxAge time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, job := range q.jobs {
+		switch job.Status {
+		case StatusQueued, StatusRunning:
+			continue
+		}
+		if time.Since(job.FinishedAt) < maxAge {
+			continue
+		}
+		os.RemoveAll(q.jobDir(id))
+		delete(q.jobs, id)
+		delete(q.cancels, id)
+	}
+}
+
+// StartSweeper runs Sweep on a fixed interval until the process exits.
+func (q *Queue) StartSweeper(interval, maxAge time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			q.Sweep(maxAge)
+		}
+	}()
+}